@@ -0,0 +1,149 @@
+package stm
+
+// This file provides higher-level concurrency primitives built entirely out
+// of TVar, Atomically and Retry, modeled on Haskell's
+// Control.Concurrent.STM.TChan, TQueue and TMVar. Because they are ordinary
+// STM code, they compose transactionally: a single Atomically can, say,
+// dequeue from one TQueue and enqueue into another with no intermediate
+// state observable to anyone else -- something plain channels cannot do.
+
+// A TChan is an unbounded FIFO channel of values of type T, modeled on
+// Haskell's TChan.
+type TChan[T any] struct {
+	v *TVar[[]T]
+}
+
+// NewTChan returns a new, empty TChan.
+func NewTChan[T any]() *TChan[T] {
+	return &TChan[T]{v: NewTVar([]T(nil))}
+}
+
+// Send appends v to the channel. Unlike TQueue, TChan keeps its contents in
+// a single slice and copies it on every Send/Recv; it favors simplicity over
+// TQueue's amortized O(1) operations.
+func (c *TChan[T]) Send(tx *Tx, v T) {
+	cur := GetT(tx, c.v)
+	next := make([]T, len(cur)+1)
+	copy(next, cur)
+	next[len(cur)] = v
+	SetT(tx, c.v, next)
+}
+
+// Recv removes and returns the value at the front of the channel, retrying
+// if the channel is empty.
+func (c *TChan[T]) Recv(tx *Tx) T {
+	cur := GetT(tx, c.v)
+	tx.Assert(len(cur) > 0)
+	SetT(tx, c.v, append([]T(nil), cur[1:]...))
+	return cur[0]
+}
+
+// queueNode is a singly-linked, immutable list cell. Being immutable, cells
+// can be freely shared between a Var's committed value and a transaction's
+// tentative one without the copy-on-write a mutable slice would need.
+type queueNode[T any] struct {
+	val  T
+	next *queueNode[T]
+}
+
+// A TQueue is an unbounded FIFO queue of values of type T, modeled on
+// Haskell's TQueue. It is implemented as the classic two-list queue: Write
+// conses onto write (a LIFO list of items in arrival order, newest first),
+// and Read pops from the front of read, reversing write into read only when
+// read runs dry. Every item is therefore built into a list cell at most
+// twice over its lifetime, however many Reads happen ahead of it, giving
+// amortized O(1) Write/Read instead of the O(n) each would cost if the
+// queue were kept as a single slice with front removal.
+type TQueue[T any] struct {
+	read  *TVar[*queueNode[T]]
+	write *TVar[*queueNode[T]]
+}
+
+// NewTQueue returns a new, empty TQueue.
+func NewTQueue[T any]() *TQueue[T] {
+	return &TQueue[T]{read: NewTVar((*queueNode[T])(nil)), write: NewTVar((*queueNode[T])(nil))}
+}
+
+// Write appends v to the queue.
+func (q *TQueue[T]) Write(tx *Tx, v T) {
+	w := GetT(tx, q.write)
+	SetT(tx, q.write, &queueNode[T]{val: v, next: w})
+}
+
+// Read removes and returns the value at the front of the queue, retrying if
+// the queue is empty.
+func (q *TQueue[T]) Read(tx *Tx) T {
+	if r := GetT(tx, q.read); r != nil {
+		SetT(tx, q.read, r.next)
+		return r.val
+	}
+	w := GetT(tx, q.write)
+	tx.Assert(w != nil)
+	var rev *queueNode[T]
+	for n := w; n != nil; n = n.next {
+		rev = &queueNode[T]{val: n.val, next: rev}
+	}
+	SetT(tx, q.write, nil)
+	SetT(tx, q.read, rev.next)
+	return rev.val
+}
+
+// tmvarState is the contents of a TMVar: either empty, or full with val.
+type tmvarState[T any] struct {
+	full bool
+	val  T
+}
+
+// A TMVar is a transactional mutable variable that is always either empty
+// or full, modeled on Haskell's TMVar. It is useful as a single-slot
+// rendezvous point or lock.
+type TMVar[T any] struct {
+	v *TVar[tmvarState[T]]
+}
+
+// NewTMVar returns a TMVar containing val.
+func NewTMVar[T any](val T) *TMVar[T] {
+	return &TMVar[T]{v: NewTVar(tmvarState[T]{full: true, val: val})}
+}
+
+// NewEmptyTMVar returns an empty TMVar.
+func NewEmptyTMVar[T any]() *TMVar[T] {
+	return &TMVar[T]{v: NewTVar(tmvarState[T]{})}
+}
+
+// Take empties m and returns its previous contents, retrying if m is empty.
+func (m *TMVar[T]) Take(tx *Tx) T {
+	s := GetT(tx, m.v)
+	tx.Assert(s.full)
+	SetT(tx, m.v, tmvarState[T]{})
+	return s.val
+}
+
+// Put fills m with val, retrying if m is already full.
+func (m *TMVar[T]) Put(tx *Tx, val T) {
+	s := GetT(tx, m.v)
+	tx.Assert(!s.full)
+	SetT(tx, m.v, tmvarState[T]{full: true, val: val})
+}
+
+// TryTake empties m and returns its previous contents, if m is full. It
+// never retries; ok is false if m was already empty.
+func (m *TMVar[T]) TryTake(tx *Tx) (val T, ok bool) {
+	s := GetT(tx, m.v)
+	if !s.full {
+		return val, false
+	}
+	SetT(tx, m.v, tmvarState[T]{})
+	return s.val, true
+}
+
+// TryPut fills m with val, if m is empty. It never retries; it returns false
+// if m was already full.
+func (m *TMVar[T]) TryPut(tx *Tx, val T) bool {
+	s := GetT(tx, m.v)
+	if s.full {
+		return false
+	}
+	SetT(tx, m.v, tmvarState[T]{full: true, val: val})
+	return true
+}
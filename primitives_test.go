@@ -0,0 +1,130 @@
+package stm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTChanSendRecvOrder(t *testing.T) {
+	c := NewTChan[int]()
+	Atomically(func(tx *Tx) {
+		c.Send(tx, 1)
+		c.Send(tx, 2)
+		c.Send(tx, 3)
+	})
+	for _, want := range []int{1, 2, 3} {
+		var got int
+		Atomically(func(tx *Tx) { got = c.Recv(tx) })
+		if got != want {
+			t.Fatalf("got %d, want %d", got, want)
+		}
+	}
+}
+
+func TestTChanRecvBlocks(t *testing.T) {
+	c := NewTChan[int]()
+	done := make(chan int, 1)
+	go func() {
+		var v int
+		Atomically(func(tx *Tx) { v = c.Recv(tx) })
+		done <- v
+	}()
+	Atomically(func(tx *Tx) { c.Send(tx, 7) })
+	select {
+	case v := <-done:
+		if v != 7 {
+			t.Fatalf("got %d, want 7", v)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TChan.Recv hung")
+	}
+}
+
+func TestTQueueFIFOOrderAcrossDrain(t *testing.T) {
+	q := NewTQueue[int]()
+	Atomically(func(tx *Tx) {
+		q.Write(tx, 1)
+		q.Write(tx, 2)
+	})
+	var first int
+	Atomically(func(tx *Tx) { first = q.Read(tx) })
+	Atomically(func(tx *Tx) { q.Write(tx, 3) })
+	var second, third int
+	Atomically(func(tx *Tx) { second = q.Read(tx) })
+	Atomically(func(tx *Tx) { third = q.Read(tx) })
+
+	got := []int{first, second, third}
+	want := []int{1, 2, 3}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestTQueueReadBlocks(t *testing.T) {
+	q := NewTQueue[int]()
+	done := make(chan int, 1)
+	go func() {
+		var v int
+		Atomically(func(tx *Tx) { v = q.Read(tx) })
+		done <- v
+	}()
+	Atomically(func(tx *Tx) { q.Write(tx, 9) })
+	select {
+	case v := <-done:
+		if v != 9 {
+			t.Fatalf("got %d, want 9", v)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TQueue.Read hung")
+	}
+}
+
+func TestTMVarPutTake(t *testing.T) {
+	m := NewEmptyTMVar[int]()
+	Atomically(func(tx *Tx) { m.Put(tx, 42) })
+	var got int
+	Atomically(func(tx *Tx) { got = m.Take(tx) })
+	if got != 42 {
+		t.Fatalf("got %d, want 42", got)
+	}
+}
+
+func TestTMVarTakeBlocksUntilPut(t *testing.T) {
+	m := NewEmptyTMVar[int]()
+	done := make(chan int, 1)
+	go func() {
+		var v int
+		Atomically(func(tx *Tx) { v = m.Take(tx) })
+		done <- v
+	}()
+	Atomically(func(tx *Tx) { m.Put(tx, 5) })
+	select {
+	case v := <-done:
+		if v != 5 {
+			t.Fatalf("got %d, want 5", v)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("TMVar.Take hung")
+	}
+}
+
+func TestTMVarTryTakeTryPut(t *testing.T) {
+	m := NewEmptyTMVar[int]()
+	Atomically(func(tx *Tx) {
+		if _, ok := m.TryTake(tx); ok {
+			t.Fatal("TryTake on empty TMVar should fail")
+		}
+		if !m.TryPut(tx, 1) {
+			t.Fatal("TryPut on empty TMVar should succeed")
+		}
+		if m.TryPut(tx, 2) {
+			t.Fatal("TryPut on full TMVar should fail")
+		}
+		v, ok := m.TryTake(tx)
+		if !ok || v != 1 {
+			t.Fatalf("TryTake = %d, %v; want 1, true", v, ok)
+		}
+	})
+}
@@ -74,75 +74,272 @@ interface{} and type assertions. Furthermore, Haskell can enforce at compile
 time that STM variables are not modified outside the STM monad. This is not
 possible in Go, so be especially careful when using pointers in your STM code.
 
+As of Go 1.18, generics close part of that gap: TVar[T], in place of Var,
+gives a compile-time-typed variable akin to Haskell's TVar a. NewTVar creates
+one, and the package-level GetT/SetT functions replace tx.Get/tx.Set:
+
+	x := stm.NewTVar(3)
+	stm.Atomically(func(tx *stm.Tx) {
+		cur := stm.GetT(tx, x)
+		stm.SetT(tx, x, cur-1)
+	})
+
+A Var and a TVar[T] may be freely mixed within the same transaction.
+
+Internally, each Var carries a version number rather than being guarded by a
+single package-wide lock. A transaction samples a global version clock when
+it starts, validates every Get against that snapshot, and at commit time
+locks only the Vars it wrote (in a fixed order, to avoid deadlock) before
+revalidating and publishing. This lets unrelated transactions commit
+concurrently instead of serializing on one mutex.
+
+RegisterInvariant lets you assert, once, a property that must hold across
+every transaction that commits -- mirroring Haskell STM's always and
+alwaysSucceeds -- instead of re-checking it in every mutator:
+
+	stm.RegisterInvariant(func(tx *stm.Tx) bool {
+		return tx.Get(x).(int) >= 0
+	})
+
+If the invariant is ever violated by a commit, Atomically panics with
+ErrInvariantViolated rather than retrying.
+
 It remains to be seen whether this style of concurrency has practical
 applications in Go. If you find this package useful, please tell me about it!
 */
 package stm
 
 import (
+	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 )
 
 // Retry is a sentinel value. When thrown via panic, it indicates that a
 // transaction should be retried.
 const Retry = "retry"
 
-// The globalLock serializes transaction verification/committal.
-var globalLock sync.Mutex
+// invalidRead is an internal sentinel panic value. It indicates that a
+// transaction observed a Var whose version is newer than the transaction's
+// start-of-day snapshot, i.e. the read is already stale. Unlike Retry, it
+// causes Atomically to restart the transaction immediately rather than
+// blocking, since there is nothing new here to wait for.
+const invalidRead = "stm: invalid read"
+
+// globalVersion is a monotonic clock, incremented on every commit that
+// writes at least one Var. A transaction samples it at start and uses the
+// sample to validate every subsequent Get against a consistent snapshot.
+var globalVersion atomic.Uint64
+
+// varBase holds the untyped machinery shared by Var and the generic TVar[T]:
+// the current value, its version, and the waiter channels used for blocking
+// retry. Keying tx.reads/tx.writes on *varBase, rather than on *Var or
+// *TVar[T] directly, lets the transaction log stay monomorphic while Var and
+// TVar[T] each present their own typed or untyped face to callers.
+//
+// mu guards val and waiters. version is bumped only while mu is held for
+// writing, so a reader holding mu for reading always sees a matching
+// (val, version) pair; it is atomic so commit can order the lock for a
+// var's value/waiters separately from validating versions for vars it only
+// read (see (*Tx).commit).
+type varBase struct {
+	mu      sync.RWMutex
+	val     interface{}
+	version atomic.Uint64
+	// waiters are channels registered by transactions that read this var
+	// and then retried. They are closed (and cleared) whenever a commit
+	// writes to the var, waking every transaction blocked on it. Guarded
+	// by mu.
+	waiters []chan struct{}
+}
+
+// addWaiter registers ch to be closed the next time v is written, and
+// returns v's current version. The version is read under the same lock as
+// the registration so the caller can tell whether a write has already
+// landed (and thus already missed this waiter, e.g. by committing between
+// the caller's last read of v and this call) by comparing it against the
+// version the caller read earlier.
+func (v *varBase) addWaiter(ch chan struct{}) uint64 {
+	v.mu.Lock()
+	v.waiters = append(v.waiters, ch)
+	ver := v.version.Load()
+	v.mu.Unlock()
+	return ver
+}
+
+// notifyLocked wakes every transaction waiting on v. The caller must hold
+// v.mu for writing.
+func (v *varBase) notifyLocked() {
+	for _, ch := range v.waiters {
+		close(ch)
+	}
+	v.waiters = nil
+}
 
 // A Var holds an STM variable.
 type Var struct {
-	val interface{}
+	base *varBase
 }
 
 // NewVar returns a new STM variable.
 func NewVar(val interface{}) *Var {
-	return &Var{val}
+	return &Var{base: &varBase{val: val}}
+}
+
+// A TVar holds a typed STM variable, named after Haskell's TVar. It is a
+// generics-based alternative to Var: GetT and SetT give callers compile-time
+// type safety instead of the interface{} type assertions Var requires. TVar
+// shares its transaction machinery with Var, so a TVar and a Var can be read
+// or written within the same transaction.
+type TVar[T any] struct {
+	base *varBase
+}
+
+// NewTVar returns a new typed STM variable.
+func NewTVar[T any](val T) *TVar[T] {
+	return &TVar[T]{base: &varBase{val: val}}
+}
+
+// GetT returns the value of v as of the start of the transaction.
+func GetT[T any](tx *Tx, v *TVar[T]) T {
+	return tx.get(v.base).(T)
+}
+
+// SetT sets the value of a TVar for the lifetime of the transaction.
+func SetT[T any](tx *Tx, v *TVar[T], val T) {
+	tx.set(v.base, val)
+}
+
+// readEntry is what a Tx remembers about a Var it has read: the value seen
+// and the version it was tagged with, so that commit can detect whether
+// another transaction has since written to it.
+type readEntry struct {
+	val     interface{}
+	version uint64
 }
 
 // A Tx represents an atomic transaction.
 type Tx struct {
-	reads  map[*Var]interface{}
-	writes map[*Var]interface{}
+	reads  map[*varBase]readEntry
+	writes map[*varBase]interface{}
+	// startVersion is globalVersion as sampled when the transaction began;
+	// every Get is validated against it.
+	startVersion uint64
+	timeout      time.Duration
+}
+
+// newTx returns an empty transaction log.
+func newTx() *Tx {
+	return &Tx{
+		reads:  make(map[*varBase]readEntry),
+		writes: make(map[*varBase]interface{}),
+	}
 }
 
-// verify checks that none of the logged values have changed since the
-// transaction began
-func (tx *Tx) verify() bool {
-	for v, val := range tx.reads {
-		if v.val != val {
+// commit validates the transaction's reads against their current versions
+// and, if they still hold, publishes its writes. It locks only the vars the
+// transaction wrote -- in address order, to avoid deadlocking against a
+// concurrent commit -- rather than a single global lock, so unrelated
+// transactions can commit in parallel. It returns false if validation
+// failed, in which case nothing was written and the transaction must be
+// rerun.
+func (tx *Tx) commit() bool {
+	writeSet := make([]*varBase, 0, len(tx.writes))
+	for v := range tx.writes {
+		writeSet = append(writeSet, v)
+	}
+	sort.Slice(writeSet, func(i, j int) bool {
+		return uintptr(unsafe.Pointer(writeSet[i])) < uintptr(unsafe.Pointer(writeSet[j]))
+	})
+	for _, v := range writeSet {
+		v.mu.Lock()
+	}
+	defer func() {
+		for _, v := range writeSet {
+			v.mu.Unlock()
+		}
+	}()
+
+	locked := make(map[*varBase]bool, len(writeSet))
+	for _, v := range writeSet {
+		locked[v] = true
+	}
+	for v, e := range tx.reads {
+		if locked[v] {
+			if v.version.Load() != e.version {
+				return false
+			}
+			continue
+		}
+		// Never block on a var we only read: a concurrent commit may hold it
+		// while waiting on one of ours. If it is locked for writing, treat the
+		// read as stale and let the transaction rerun.
+		if !v.mu.TryRLock() {
+			return false
+		}
+		cur := v.version.Load()
+		v.mu.RUnlock()
+		if cur != e.version {
 			return false
 		}
 	}
-	return true
-}
 
-// commit writes the values in the transaction log to their respective Vars.
-func (tx *Tx) commit() {
-	for v, val := range tx.writes {
-		v.val = val
+	if len(writeSet) > 0 {
+		// Invariants can only be broken by a write, so there's nothing to
+		// re-check -- and no reason to take the locks doing so would need
+		// -- for a read-only commit.
+		if !checkInvariants(tx) {
+			panic(ErrInvariantViolated)
+		}
+
+		newVersion := globalVersion.Add(1)
+		for _, v := range writeSet {
+			v.val = tx.writes[v]
+			v.version.Store(newVersion)
+			v.notifyLocked()
+		}
 	}
+	return true
 }
 
 // Get returns the value of v as of the start of the transaction.
 func (tx *Tx) Get(v *Var) interface{} {
+	return tx.get(v.base)
+}
+
+// Set sets the value of a Var for the lifetime of the transaction.
+func (tx *Tx) Set(v *Var, val interface{}) {
+	tx.set(v.base, val)
+}
+
+// get returns the value of v as of the start of the transaction.
+func (tx *Tx) get(v *varBase) interface{} {
 	// If we previously wrote to v, it will be in the write log.
 	if val, ok := tx.writes[v]; ok {
 		return val
 	}
 	// If we previously read v, it will be in the read log.
-	if val, ok := tx.reads[v]; ok {
-		return val
+	if e, ok := tx.reads[v]; ok {
+		return e.val
 	}
-	// Otherwise, record and return its current value.
-	globalLock.Lock()
-	defer globalLock.Unlock()
-	tx.reads[v] = v.val
-	return v.val
+	// Otherwise, read its current (value, version) and record them. If the
+	// version is newer than our snapshot, someone committed to v after this
+	// transaction began, so the read is already stale.
+	v.mu.RLock()
+	val, ver := v.val, v.version.Load()
+	v.mu.RUnlock()
+	if ver > tx.startVersion {
+		panic(invalidRead)
+	}
+	tx.reads[v] = readEntry{val: val, version: ver}
+	return val
 }
 
-// Set sets the value of a Var for the lifetime of the transaction.
-func (tx *Tx) Set(v *Var, val interface{}) {
+// set sets the value of v for the lifetime of the transaction.
+func (tx *Tx) set(v *varBase, val interface{}) {
 	tx.writes[v] = val
 }
 
@@ -151,6 +348,14 @@ func (tx *Tx) Retry() {
 	panic(Retry)
 }
 
+// RetryTimeout behaves like Retry, but also causes Atomically to give up
+// waiting and rerun the transaction after d elapses, even if none of the
+// Vars it read have changed.
+func (tx *Tx) RetryTimeout(d time.Duration) {
+	tx.timeout = d
+	tx.Retry()
+}
+
 // Assert is a helper function that retries a transaction if the condition is
 // not satisfied.
 func (tx *Tx) Assert(p bool) {
@@ -159,7 +364,90 @@ func (tx *Tx) Assert(p bool) {
 	}
 }
 
-// catchRetry returns true if fn calls tx.Retry.
+// ErrInvariantViolated is panicked out of Atomically when a registered
+// invariant does not hold against a transaction's tentative post-commit
+// state. Unlike Retry, it is not retried; the transaction is abandoned.
+var ErrInvariantViolated = errors.New("stm: invariant violated")
+
+// An InvariantHandle identifies an invariant registered with
+// RegisterInvariant, for later removal via UnregisterInvariant.
+type InvariantHandle struct {
+	id uint64
+}
+
+var (
+	invariantsMu    sync.Mutex
+	invariants      = make(map[uint64]func(*Tx) bool)
+	nextInvariantID atomic.Uint64
+)
+
+// RegisterInvariant registers fn as a global invariant, modeled on Haskell
+// STM's always/alwaysSucceeds. After every transaction that commits at least
+// one write, fn is run against the post-commit state, before the commit's writes become
+// visible to anyone else; if fn returns false or panics, the commit is
+// aborted and ErrInvariantViolated is raised instead. This lets a data
+// structure's invariants be expressed once and enforced across every
+// mutator, rather than re-checked by each one.
+func RegisterInvariant(fn func(*Tx) bool) InvariantHandle {
+	id := nextInvariantID.Add(1)
+	invariantsMu.Lock()
+	invariants[id] = fn
+	invariantsMu.Unlock()
+	return InvariantHandle{id: id}
+}
+
+// UnregisterInvariant removes an invariant previously registered with
+// RegisterInvariant.
+func UnregisterInvariant(h InvariantHandle) {
+	invariantsMu.Lock()
+	delete(invariants, h.id)
+	invariantsMu.Unlock()
+}
+
+// checkInvariants runs every registered invariant against tx's tentative
+// post-commit state: tx's writes, overlaid on the current value of every
+// other Var. The caller must hold the locks on tx's write set.
+func checkInvariants(tx *Tx) bool {
+	invariantsMu.Lock()
+	fns := make([]func(*Tx) bool, 0, len(invariants))
+	for _, fn := range invariants {
+		fns = append(fns, fn)
+	}
+	invariantsMu.Unlock()
+	if len(fns) == 0 {
+		return true
+	}
+
+	view := &Tx{
+		reads:        make(map[*varBase]readEntry),
+		writes:       make(map[*varBase]interface{}, len(tx.writes)),
+		startVersion: globalVersion.Load(),
+	}
+	for v, val := range tx.writes {
+		view.writes[v] = val
+	}
+	for _, fn := range fns {
+		if !runInvariant(fn, view) {
+			return false
+		}
+	}
+	return true
+}
+
+// runInvariant runs fn against tx, treating both a false result and a panic
+// as invariant failure.
+func runInvariant(fn func(*Tx) bool, tx *Tx) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return fn(tx)
+}
+
+// catchRetry returns true if fn calls tx.Retry. Any other panic, including
+// invalidRead, propagates to the caller; only Atomically handles invalidRead,
+// since only it knows whether to restart immediately or block.
 func catchRetry(fn func(*Tx), tx *Tx) (retry bool) {
 	defer func() {
 		if r := recover(); r == Retry {
@@ -172,9 +460,41 @@ func catchRetry(fn func(*Tx), tx *Tx) (retry bool) {
 	return
 }
 
+// attempt runs fn against tx and reports what happened: it committed
+// (outcomeCommit, subject to (*Tx).commit's own validation), it called
+// Retry (outcomeRetry), or it observed a stale read (outcomeInvalid).
+type txOutcome int
+
+const (
+	outcomeCommit txOutcome = iota
+	outcomeRetry
+	outcomeInvalid
+)
+
+func attempt(fn func(*Tx), tx *Tx) (outcome txOutcome) {
+	defer func() {
+		switch r := recover(); r {
+		case nil:
+			outcome = outcomeCommit
+		case Retry:
+			outcome = outcomeRetry
+		case invalidRead:
+			outcome = outcomeInvalid
+		default:
+			panic(r)
+		}
+	}()
+	fn(tx)
+	return
+}
+
 // Select runs the supplied functions in order. Execution stops when a
 // function succeeds without calling Retry. If no functions succeed, the
 // entire selection will be retried.
+//
+// Select runs every alternative directly against tx, so an alternative that
+// retries leaves both its reads and any writes it made in tx's log; use
+// OrElse when a retried alternative's writes must be discarded.
 func Select(fns ...func(*Tx)) func(*Tx) {
 	return func(tx *Tx) {
 		switch len(fns) {
@@ -191,28 +511,105 @@ func Select(fns ...func(*Tx)) func(*Tx) {
 	}
 }
 
+// OrElse is Haskell STM's orElse: it runs a, and if a calls Retry, runs b
+// instead. Unlike Select, OrElse discards the writes of a retried first
+// alternative while keeping its read set. a is run against a nested
+// transaction log; if it retries, only the vars it read are merged into tx's
+// read log before b is attempted, so that
+// a subsequent block-and-wait (see Atomically) subscribes to changes in
+// either alternative. If b also retries, its reads -- already recorded
+// directly in tx -- are included for the same reason, and the retry is
+// propagated to the caller.
+func OrElse(a, b func(*Tx)) func(*Tx) {
+	return func(tx *Tx) {
+		sub := newTx()
+		sub.startVersion = tx.startVersion
+		// Seed sub with tx's own reads/writes so that a (and, on retry, b)
+		// see the enclosing transaction's pending writes and already-read
+		// values, rather than falling through to the last committed state.
+		for v, e := range tx.reads {
+			sub.reads[v] = e
+		}
+		for v, val := range tx.writes {
+			sub.writes[v] = val
+		}
+		if catchRetry(a, sub) {
+			for v, val := range sub.reads {
+				tx.reads[v] = val
+			}
+			if catchRetry(b, tx) {
+				tx.Retry()
+			}
+			return
+		}
+		for v, val := range sub.reads {
+			tx.reads[v] = val
+		}
+		for v, val := range sub.writes {
+			tx.writes[v] = val
+		}
+	}
+}
+
 // Atomically executes the atomic function fn.
 func Atomically(fn func(*Tx)) {
 retry:
 	// run the transaction
-	tx := &Tx{
-		reads:  make(map[*Var]interface{}),
-		writes: make(map[*Var]interface{}),
-	}
-	if catchRetry(fn, tx) {
+	tx := newTx()
+	tx.startVersion = globalVersion.Load()
+	switch attempt(fn, tx) {
+	case outcomeRetry:
+		block(tx)
+		goto retry
+	case outcomeInvalid:
+		// A Var changed under us mid-transaction; there's nothing to wait
+		// for, so just try again with a fresh snapshot.
 		goto retry
 	}
-	// verify the read log
-	globalLock.Lock()
-	if !tx.verify() {
-		globalLock.Unlock()
+	// validate the read log and commit the write log
+	if !tx.commit() {
 		goto retry
 	}
-	// commit the write log
-	if len(tx.writes) > 0 {
-		tx.commit()
+}
+
+// block waits for a Var read by tx to change before the transaction is
+// rerun. It registers a single channel on every Var in tx.reads and sleeps
+// until one of them is written (see varBase.notifyLocked), or until
+// tx.timeout elapses, if set via RetryTimeout. If tx read no Vars, it blocks
+// forever.
+//
+// Registration happens after the transaction already failed, so a write to
+// one of tx.reads's Vars may land in the gap between that failure and this
+// call; such a write can never see (and so never notify) the channel
+// registered here. addWaiter guards against this by reporting each Var's
+// version at registration time, which block compares against the version
+// the transaction read; any mismatch means the Var already changed, and
+// block returns immediately instead of waiting on a channel that nothing
+// will ever close.
+func block(tx *Tx) {
+	ch := make(chan struct{})
+	for v, e := range tx.reads {
+		if v.addWaiter(ch) != e.version {
+			// v was already written (by a commit that ran entirely
+			// between our last read of it and this registration, and so
+			// could not have seen ch to notify); treat that the same as
+			// an already-delivered notification rather than waiting on a
+			// channel nothing will ever close. Stop registering on the
+			// remaining vars -- we're not going to wait on ch, so leaving
+			// it sitting in their waiters lists would only leak memory
+			// until they happen to be written.
+			return
+		}
+	}
+
+	if tx.timeout > 0 {
+		select {
+		case <-ch:
+		case <-time.After(tx.timeout):
+		}
+		return
 	}
-	globalLock.Unlock()
+	<-ch
 }
 
 // AtomicGet is a helper function that atomically reads a value.
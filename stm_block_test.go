@@ -0,0 +1,81 @@
+package stm
+
+import (
+	"testing"
+	"time"
+)
+
+// TestDecrementIfNonzeroBlocks exercises the blocking "decrement-if-nonzero"
+// example from the package doc under a writer/reader race: a reader retries
+// while x is zero, and must wake as soon as a concurrent writer commits a
+// nonzero value, rather than hanging.
+func TestDecrementIfNonzeroBlocks(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		x := NewVar(0)
+		done := make(chan struct{})
+		go func() {
+			Atomically(func(tx *Tx) {
+				cur := tx.Get(x).(int)
+				tx.Assert(cur != 0)
+				tx.Set(x, cur-1)
+			})
+			close(done)
+		}()
+		AtomicSet(x, 1)
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("iteration %d: decrement-if-nonzero hung", i)
+		}
+	}
+}
+
+// TestBlockMissedNotification is a regression test for a lost-wakeup bug:
+// block registers waiters after the transaction's attempt already failed,
+// so a commit landing in that gap must still be detected (via the version
+// comparison in addWaiter) rather than leaving block waiting on a channel
+// nothing will ever close.
+func TestBlockMissedNotification(t *testing.T) {
+	x := NewVar(0)
+	tx := newTx()
+	tx.startVersion = globalVersion.Load()
+	tx.Get(x) // record x's version before it's written
+
+	AtomicSet(x, 1) // commits and notifies, but tx isn't registered yet
+
+	done := make(chan struct{})
+	go func() {
+		block(tx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("block() hung on a write that landed before waiter registration")
+	}
+}
+
+// TestBlockTimeout checks that block returns once tx.timeout elapses, as set
+// by RetryTimeout, even though no Var it read ever changes.
+func TestBlockTimeout(t *testing.T) {
+	x := NewVar(0)
+	tx := newTx()
+	tx.startVersion = globalVersion.Load()
+	tx.Get(x)
+	tx.timeout = 20 * time.Millisecond
+
+	done := make(chan struct{})
+	start := time.Now()
+	go func() {
+		block(tx)
+		close(done)
+	}()
+	select {
+	case <-done:
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("block took %s, want ~%s", elapsed, tx.timeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("block() with a timeout did not return on its own")
+	}
+}
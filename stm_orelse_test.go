@@ -0,0 +1,70 @@
+package stm
+
+import (
+	"testing"
+	"time"
+)
+
+// TestOrElseReadYourOwnWrites guards against OrElse running its first
+// alternative against an empty sub-log: a transaction's own prior writes
+// (and reads) must be visible to that alternative, not just the last
+// committed value.
+func TestOrElseReadYourOwnWrites(t *testing.T) {
+	v := NewVar(5)
+	var got int
+	Atomically(func(tx *Tx) {
+		tx.Set(v, 99)
+		OrElse(
+			func(tx *Tx) { got = tx.Get(v).(int) },
+			func(tx *Tx) { tx.Retry() },
+		)(tx)
+	})
+	if got != 99 {
+		t.Fatalf("got %d, want 99 (should see the transaction's own pending write)", got)
+	}
+}
+
+// TestOrElseReadYourOwnWritesSecondAlternative checks the same thing for
+// the second alternative, reached when the first retries.
+func TestOrElseReadYourOwnWritesSecondAlternative(t *testing.T) {
+	v := NewVar(5)
+	var got int
+	Atomically(func(tx *Tx) {
+		tx.Set(v, 42)
+		OrElse(
+			func(tx *Tx) { tx.Retry() },
+			func(tx *Tx) { got = tx.Get(v).(int) },
+		)(tx)
+	})
+	if got != 42 {
+		t.Fatalf("got %d, want 42", got)
+	}
+}
+
+// TestOrElseBlocksOnUnionOfReads checks that a transaction built from
+// OrElse blocks until either alternative's reads change, not just the
+// reads of whichever alternative happened to run last.
+func TestOrElseBlocksOnUnionOfReads(t *testing.T) {
+	x := NewVar(0)
+	y := NewVar(0)
+	done := make(chan struct{})
+	go func() {
+		Atomically(OrElse(
+			func(tx *Tx) { tx.Assert(tx.Get(x).(int) != 0) },
+			func(tx *Tx) { tx.Assert(tx.Get(y).(int) != 0) },
+		))
+		close(done)
+	}()
+
+	// Give the goroutine a chance to register as a waiter on both x and y
+	// before we write to x; if OrElse discarded the first alternative's
+	// reads, this write would never wake it.
+	time.Sleep(10 * time.Millisecond)
+	AtomicSet(x, 1)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("OrElse did not wake on a write to the first alternative's read set")
+	}
+}
@@ -0,0 +1,71 @@
+package stm
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestConcurrentCommitValidation drives many goroutines through the same
+// read-modify-write transaction concurrently, which only produces the
+// correct total if (*Tx).commit's per-Var version validation actually
+// forces conflicting commits to retry instead of clobbering each other.
+func TestConcurrentCommitValidation(t *testing.T) {
+	const goroutines = 50
+	const incrPerGoroutine = 200
+
+	x := NewVar(0)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incrPerGoroutine; j++ {
+				Atomically(func(tx *Tx) {
+					cur := tx.Get(x).(int)
+					tx.Set(x, cur+1)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := goroutines * incrPerGoroutine
+	if got := AtomicGet(x).(int); got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+}
+
+// TestConcurrentCommitValidationMultiVar does the same, but across two Vars
+// written together, to exercise commit's address-ordered locking of a
+// multi-Var write set.
+func TestConcurrentCommitValidationMultiVar(t *testing.T) {
+	const goroutines = 50
+	const incrPerGoroutine = 200
+
+	x := NewVar(0)
+	y := NewVar(0)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incrPerGoroutine; j++ {
+				Atomically(func(tx *Tx) {
+					cx := tx.Get(x).(int)
+					cy := tx.Get(y).(int)
+					tx.Set(x, cx+1)
+					tx.Set(y, cy+1)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := goroutines * incrPerGoroutine
+	if got := AtomicGet(x).(int); got != want {
+		t.Fatalf("x: got %d, want %d", got, want)
+	}
+	if got := AtomicGet(y).(int); got != want {
+		t.Fatalf("y: got %d, want %d", got, want)
+	}
+}